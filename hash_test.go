@@ -0,0 +1,34 @@
+package s3
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payload")
+	if err := os.WriteFile(path, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	sha256sum, md5sum, err := hashFile(path)
+	if err != nil {
+		t.Fatalf("hashFile: %s", err)
+	}
+
+	const wantSHA256 = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	const wantMD5 = "XrY7u+Ae7tCTyyK7j1rNww=="
+	if sha256sum != wantSHA256 {
+		t.Errorf("sha256 = %s, want %s", sha256sum, wantSHA256)
+	}
+	if md5sum != wantMD5 {
+		t.Errorf("md5 = %s, want %s", md5sum, wantMD5)
+	}
+}
+
+func TestHashFileMissing(t *testing.T) {
+	if _, _, err := hashFile(filepath.Join(t.TempDir(), "does-not-exist")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
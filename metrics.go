@@ -0,0 +1,85 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are labeled by bucket and prefix rather than scoped per plugin
+// instance, so a single Heka pipeline running many S3Output instances still
+// exposes one /metrics endpoint that can be broken down by failing prefix.
+var (
+	bytesBufferedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "heka_s3",
+		Name:      "bytes_buffered_total",
+		Help:      "Total bytes written into the in-memory buffer.",
+	}, []string{"bucket", "prefix"})
+
+	bytesUploadedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "heka_s3",
+		Name:      "bytes_uploaded_total",
+		Help:      "Total bytes successfully uploaded to S3.",
+	}, []string{"bucket", "prefix"})
+
+	uploadLatencySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "heka_s3",
+		Name:      "upload_latency_seconds",
+		Help:      "Latency of S3 upload attempts.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"bucket", "prefix"})
+
+	uploadErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "heka_s3",
+		Name:      "upload_errors_total",
+		Help:      "Total upload attempts that ended in error.",
+	}, []string{"bucket", "prefix"})
+
+	uploadRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "heka_s3",
+		Name:      "upload_retries_total",
+		Help:      "Total retries issued after a transient upload error.",
+	}, []string{"bucket", "prefix"})
+
+	bufferSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "heka_s3",
+		Name:      "buffer_size_bytes",
+		Help:      "Current size of the on-disk buffer file.",
+	}, []string{"bucket", "prefix"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		bytesBufferedTotal,
+		bytesUploadedTotal,
+		uploadLatencySeconds,
+		uploadErrorsTotal,
+		uploadRetriesTotal,
+		bufferSizeBytes,
+	)
+}
+
+// metricLabels returns the bucket/prefix label set this S3Output instance
+// reports its metrics under.
+func (so *S3Output) metricLabels() prometheus.Labels {
+	return prometheus.Labels{"bucket": so.config.Bucket, "prefix": so.config.Prefix}
+}
+
+// startMetricsServer exposes the registered Prometheus metrics over HTTP if
+// MetricsAddr is configured. Errors are logged rather than failing Init,
+// since a dead metrics endpoint shouldn't stop the plugin from shipping
+// data.
+func (so *S3Output) startMetricsServer() {
+	if so.config.MetricsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(so.config.MetricsAddr, mux); err != nil {
+			so.logger.WithError(err).Error(fmt.Sprintf("metrics server on %s exited", so.config.MetricsAddr))
+		}
+	}()
+}
@@ -0,0 +1,74 @@
+package s3
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// transientErrorCodes are the S3/SDK error codes worth retrying: request
+// throttling, transient 5xx responses, and client-side request timeouts.
+var transientErrorCodes = map[string]bool{
+	"RequestTimeout":          true,
+	"RequestTimeoutException": true,
+	"Throttling":              true,
+	"ThrottlingException":     true,
+	"SlowDown":                true,
+	"ServiceUnavailable":      true,
+	"InternalError":           true,
+}
+
+// isTransientError reports whether err looks like a transient S3 failure
+// (throttling, a 5xx, or a request timeout) worth retrying.
+func isTransientError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return transientErrorCodes[awsErr.Code()]
+	}
+	return false
+}
+
+// backoffWithJitter applies full jitter to base, per the "Exponential
+// Backoff And Jitter" AWS architecture blog post: a random duration
+// between 0 and base, rather than a fixed delay, so retrying workers don't
+// all wake up in lockstep.
+func backoffWithJitter(base time.Duration) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(base)))
+}
+
+// uploadWithRetry uploads the rotated buffer file at path, retrying
+// transient S3 errors with exponential backoff and full jitter up to
+// MaxRetries times. A non-transient error, or exhausting retries, leaves
+// the file on disk for recoverOrphanBuffers to pick up on the next restart.
+func (so *S3Output) uploadWithRetry(path string, or OutputRunner, isMidnight bool) {
+	backoff := time.Duration(so.config.InitialBackoff) * time.Millisecond
+	maxBackoff := time.Duration(so.config.MaxBackoff) * time.Millisecond
+
+	var err error
+	for attempt := 0; attempt <= so.config.MaxRetries; attempt++ {
+		err = so.uploadFile(path, or, isMidnight, attempt)
+		if err == nil {
+			return
+		}
+		if attempt == so.config.MaxRetries || !isTransientError(err) {
+			break
+		}
+
+		uploadRetriesTotal.With(so.metricLabels()).Inc()
+		sleep := backoffWithJitter(backoff)
+		or.LogMessage(fmt.Sprintf("Upload attempt %d for %s failed, retrying in %s: %s", attempt+1, path, sleep, err))
+		time.Sleep(sleep)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	or.LogMessage(fmt.Sprintf("Warning, unable to upload %s: %s", path, err))
+}
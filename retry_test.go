@@ -0,0 +1,42 @@
+package s3
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+)
+
+func TestIsTransientError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"throttling", awserr.New("Throttling", "slow down", nil), true},
+		{"service unavailable", awserr.New("ServiceUnavailable", "try again", nil), true},
+		{"access denied", awserr.New("AccessDenied", "nope", nil), false},
+		{"non-aws error", errors.New("boom"), false},
+	}
+
+	for _, c := range cases {
+		if got := isTransientError(c.err); got != c.want {
+			t.Errorf("isTransientError(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBackoffWithJitter(t *testing.T) {
+	if got := backoffWithJitter(0); got != 0 {
+		t.Errorf("backoffWithJitter(0) = %s, want 0", got)
+	}
+
+	base := 100 * time.Millisecond
+	for i := 0; i < 50; i++ {
+		got := backoffWithJitter(base)
+		if got < 0 || got >= base {
+			t.Fatalf("backoffWithJitter(%s) = %s, want in [0, %s)", base, got, base)
+		}
+	}
+}
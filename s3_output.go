@@ -3,16 +3,29 @@ package s3
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/crowdmob/goamz/aws"
-	"github.com/crowdmob/goamz/s3"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go-v2/aws/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
 	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/sirupsen/logrus"
 )
 
 const INTERVAL_PERIOD time.Duration = 24 * time.Hour
@@ -31,14 +44,82 @@ type S3OutputConfig struct {
 	Compression      bool   `toml:"compression"`
 	BufferPath       string `toml:"buffer_path"`
 	BufferChunkLimit int    `toml:"buffer_chunk_limit"`
+
+	// Endpoint overrides the default AWS endpoint, for use against
+	// S3-compatible backends such as MinIO, Ceph RGW, or GCS interop.
+	Endpoint string `toml:"endpoint"`
+	// DisableSSL talks plain HTTP to Endpoint instead of HTTPS.
+	DisableSSL bool `toml:"disable_ssl"`
+	// S3ForcePathStyle addresses objects as endpoint/bucket/key instead
+	// of bucket.endpoint/key, as most S3-compatible backends require.
+	S3ForcePathStyle bool `toml:"s3_force_path_style"`
+	// UseIAMRole ignores AccessKey/SecretKey and sources credentials
+	// from the EC2/ECS instance role instead.
+	UseIAMRole bool `toml:"use_iam_role"`
+	// ConnectTimeout bounds how long dialing the TCP connection for an S3
+	// call may take, in seconds. ReadTimeout bounds how long to wait for
+	// the response headers once the request is sent. Neither bounds the
+	// body transfer itself, so a slow-but-progressing multipart upload of
+	// a large object is never cut off mid-stream. Zero leaves that phase
+	// without a timeout; the SDK's default HTTP client is always replaced.
+	ConnectTimeout uint `toml:"connect_timeout"`
+	ReadTimeout    uint `toml:"read_timeout"`
+
+	// ServerSideEncryption is "AES256" or "aws:kms". Empty disables SSE.
+	ServerSideEncryption string `toml:"server_side_encryption"`
+	// SSEKMSKeyId names the CMK to use when ServerSideEncryption is
+	// "aws:kms". Ignored otherwise.
+	SSEKMSKeyId string `toml:"sse_kms_key_id"`
+	// ACL is the canned ACL applied to uploaded objects, e.g. "private"
+	// or "bucket-owner-full-control". Defaults to "private".
+	ACL string `toml:"acl"`
+
+	// PartSize and Concurrency tune the multipart uploader. Zero means
+	// use the s3manager default (5 MiB parts, 5 concurrent parts).
+	PartSize    int64 `toml:"part_size"`
+	Concurrency int   `toml:"concurrency"`
+	// StreamingCompression gzips each chunk as it's appended to the
+	// buffer file in SaveToDisk, instead of gzipping the whole file in
+	// one pass at upload time. This keeps a midnight rollover from
+	// having to re-read hundreds of MB just to compress it. Relies on
+	// gzip's support for concatenated members, so the buffer file reads
+	// back as a single valid gzip stream regardless of how many flushes
+	// wrote it.
+	StreamingCompression bool `toml:"streaming_compression"`
+
+	// TrashLifetime bounds how long an orphaned ".trash.<nanos>" file is
+	// kept around before the sweeper reclaims it, in seconds.
+	TrashLifetime uint `toml:"trash_lifetime"`
+	// RaceWindow is how long, in seconds, a successfully uploaded
+	// buffer file is kept in the trash before being unlinked, giving
+	// any in-flight reader of the old path time to finish.
+	RaceWindow uint `toml:"race_window"`
+
+	// MetricsAddr, if set, starts an HTTP listener exposing Prometheus
+	// metrics at "/metrics" (e.g. ":9105").
+	MetricsAddr string `toml:"metrics_addr"`
+
+	// MaxInflightUploads bounds how many rotated buffer files can be
+	// uploading to S3 at once, so a slow PUT never blocks ingestion from
+	// inChan.
+	MaxInflightUploads int `toml:"max_inflight_uploads"`
+	// MaxRetries is how many additional attempts a transient upload
+	// error gets before the rotated buffer file is left on disk for
+	// recoverOrphanBuffers to re-upload on the next restart.
+	MaxRetries int `toml:"max_retries"`
+	// InitialBackoff and MaxBackoff, in milliseconds, bound the
+	// exponential backoff (with full jitter) applied between retries.
+	InitialBackoff uint `toml:"initial_backoff"`
+	MaxBackoff     uint `toml:"max_backoff"`
 }
 
 // S3Output is a Heka S3 output plugin.
 type S3Output struct {
 	config         *S3OutputConfig
-	client         *s3.S3
-	bucket         *s3.Bucket
+	client         *s3.Client
+	uploader       *s3manager.Uploader
 	bufferFilePath string
+	logger         logrus.FieldLogger
 }
 
 func midnightTickerUpdate() *time.Ticker {
@@ -52,32 +133,137 @@ func midnightTickerUpdate() *time.Ticker {
 
 // ConfigStruct provides the default config for a Heka plugin.
 func (so *S3Output) ConfigStruct() interface{} {
-	return &S3OutputConfig{Compression: true, BufferChunkLimit: 1000000}
+	return &S3OutputConfig{
+		Compression:        true,
+		BufferChunkLimit:   1000000,
+		ACL:                "private",
+		TrashLifetime:      3600,
+		RaceWindow:         60,
+		MaxInflightUploads: 2,
+		MaxRetries:         5,
+		InitialBackoff:     500,
+		MaxBackoff:         30000,
+	}
 }
 
 // Init is the standard Heka plugin initializer.
 func (so *S3Output) Init(config interface{}) (err error) {
 	so.config = config.(*S3OutputConfig)
-	auth, err := aws.GetAuth(so.config.AccessKey, so.config.SecretKey, "", time.Now())
+
+	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		return
 	}
-	region, ok := aws.Regions[so.config.Region]
-	if !ok {
+	cfg.Region = so.config.Region
+	cfg.HTTPClient = newHTTPClient(so.config.ConnectTimeout, so.config.ReadTimeout)
+
+	if so.config.UseIAMRole {
+		cfg.Credentials = ec2rolecreds.NewProvider(ec2metadata.New(cfg))
+	} else if so.config.AccessKey != "" || so.config.SecretKey != "" {
+		cfg.Credentials = aws.NewStaticCredentialsProvider(so.config.AccessKey, so.config.SecretKey, "")
+	}
+
+	if so.config.Region == "" && so.config.Endpoint == "" {
 		err = errors.New("Region of that name not found.")
 		return
 	}
-	so.client = s3.New(auth, region)
-	so.bucket = so.client.Bucket(so.config.Bucket)
+
+	if so.config.Endpoint != "" {
+		endpoint := so.config.Endpoint
+		if so.config.DisableSSL {
+			endpoint = "http://" + strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://")
+		}
+		cfg.EndpointResolver = aws.ResolveWithEndpointURL(endpoint)
+	} else if so.config.DisableSSL {
+		resolver := endpoints.NewDefaultResolver()
+		resolver.DisableSSL = true
+		cfg.EndpointResolver = resolver
+	}
+
+	so.client = s3.New(cfg)
+	if so.config.Endpoint != "" || so.config.S3ForcePathStyle {
+		so.client.ForcePathStyle = true
+	}
+
+	so.uploader = s3manager.NewUploaderWithClient(so.client, func(u *s3manager.Uploader) {
+		if so.config.PartSize > 0 {
+			u.PartSize = so.config.PartSize
+		}
+		if so.config.Concurrency > 0 {
+			u.Concurrency = so.config.Concurrency
+		}
+	})
 
 	prefixList := strings.Split(so.config.Prefix, "/")
 	bufferFileName := so.config.Bucket + strings.Join(prefixList, "_")
 	so.bufferFilePath = so.config.BufferPath + "/" + bufferFileName
+
+	so.logger = logrus.WithFields(logrus.Fields{
+		"bucket": so.config.Bucket,
+		"prefix": so.config.Prefix,
+	})
+	so.startMetricsServer()
+
 	return
 }
 
-// Run is the standard Heka plugin entry point.
+// newHTTPClient builds the HTTP client used for all S3 calls, applying the
+// configured connect/read timeouts when they're set. These are deliberately
+// not folded into http.Client.Timeout, which bounds an entire request
+// including streaming the body -- that would turn ReadTimeout into a hard
+// ceiling on multi-gigabyte multipart uploads instead of just the
+// connect/header phase.
+func newHTTPClient(connectTimeout, readTimeout uint) *http.Client {
+	dialer := &net.Dialer{}
+	if connectTimeout > 0 {
+		dialer.Timeout = time.Duration(connectTimeout) * time.Second
+	}
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	if readTimeout > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(readTimeout) * time.Second
+	}
+	return &http.Client{Transport: transport}
+}
+
+// uploadJob is a rotated buffer file waiting for a worker in the upload pool
+// to pick it up.
+type uploadJob struct {
+	path       string
+	isMidnight bool
+}
+
+// Run is the standard Heka plugin entry point. Uploads happen in a bounded
+// worker pool so a slow PUT never blocks draining inChan; the main loop's
+// only job is appending to the buffer file and rotating it off to a worker.
 func (so *S3Output) Run(or OutputRunner, h PluginHelper) (err error) {
+	workers := so.config.MaxInflightUploads
+	if workers < 1 {
+		workers = 1
+	}
+	uploadJobs := make(chan uploadJob, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range uploadJobs {
+				so.uploadWithRetry(job.path, or, job.isMidnight)
+			}
+		}()
+	}
+
+	// rotationJobs is unbounded (backed by an in-memory queue in
+	// dispatchUploads) so rotating a buffer off to the upload pool never
+	// blocks the select loop below, even when every worker is busy
+	// retrying a slow upload.
+	rotationJobs := make(chan uploadJob)
+	go so.dispatchUploads(rotationJobs, uploadJobs)
+
+	so.recoverOrphanBuffers(or, rotationJobs)
+
+	stopSweeper := make(chan struct{})
+	go so.runTrashSweeper(or, stopSweeper)
+
 	inChan := or.InChan()
 	tickerChan := or.Ticker()
 	buffer := bytes.NewBuffer(nil)
@@ -109,37 +295,81 @@ func (so *S3Output) Run(or OutputRunner, h PluginHelper) (err error) {
 			}
 			pack.Recycle()
 		case <-tickerChan:
-			or.LogMessage(fmt.Sprintf("Ticker fired, uploading payload."))
-			err := so.Upload(buffer, or, false)
-			if err != nil {
-				or.LogMessage(fmt.Sprintf("Warning, unable to upload payload: %s", err))
-				continue
-			}
-			or.LogMessage(fmt.Sprintf("Payload uploaded successfully."))
-			buffer.Reset()
+			or.LogMessage(fmt.Sprintf("Ticker fired, rotating payload for upload."))
+			so.enqueueRotatedBuffer(buffer, or, rotationJobs, false)
 		case <-midnightTicker.C:
 			midnightTicker = midnightTickerUpdate()
-			or.LogMessage(fmt.Sprintf("Midnight ticker fired, uploading payload."))
-			err := so.Upload(buffer, or, true)
-			if err != nil {
-				or.LogMessage(fmt.Sprintf("Warning, unable to upload payload: %s", err))
-				continue
-			}
-			or.LogMessage(fmt.Sprintf("Payload uploaded successfully."))
-			buffer.Reset()
+			or.LogMessage(fmt.Sprintf("Midnight ticker fired, rotating payload for upload."))
+			so.enqueueRotatedBuffer(buffer, or, rotationJobs, true)
 		}
 	}
 
+	close(stopSweeper)
+	close(rotationJobs)
+	wg.Wait()
+
 	or.LogMessage(fmt.Sprintf("Shutting down S3 output runner."))
 	return
 }
 
+// dispatchUploads forwards jobs from rotationJobs to uploadJobs, queuing
+// them in memory when every worker is busy instead of blocking the sender.
+// This is what lets enqueueRotatedBuffer's send never stall the main
+// select loop: a slow PUT backs up this in-memory queue, not inChan's
+// reader. Closing rotationJobs flushes any queued jobs to uploadJobs, then
+// closes uploadJobs so the worker pool can drain and exit.
+func (so *S3Output) dispatchUploads(rotationJobs <-chan uploadJob, uploadJobs chan<- uploadJob) {
+	var pending []uploadJob
+	for {
+		if len(pending) == 0 {
+			job, ok := <-rotationJobs
+			if !ok {
+				close(uploadJobs)
+				return
+			}
+			pending = append(pending, job)
+			continue
+		}
+
+		select {
+		case job, ok := <-rotationJobs:
+			if !ok {
+				for _, job := range pending {
+					uploadJobs <- job
+				}
+				close(uploadJobs)
+				return
+			}
+			pending = append(pending, job)
+		case uploadJobs <- pending[0]:
+			pending = pending[1:]
+		}
+	}
+}
+
+// enqueueRotatedBuffer flushes and rotates the active buffer file off to the
+// upload worker pool. Rotation keeps the main loop from ever waiting on a
+// PUT: the next message written after this call starts a brand new buffer
+// file.
+func (so *S3Output) enqueueRotatedBuffer(buffer *bytes.Buffer, or OutputRunner, uploadJobs chan<- uploadJob, isMidnight bool) {
+	path, err := so.rotateBuffer(buffer, or)
+	if err != nil {
+		or.LogMessage(fmt.Sprintf("Warning, unable to rotate buffer for upload: %s", err))
+		return
+	}
+	if path == "" {
+		return
+	}
+	uploadJobs <- uploadJob{path: path, isMidnight: isMidnight}
+}
+
 // WriteToBuffer writes bytes to the buffer and writes the buffer to disk if it exceeds the limit.
 func (so *S3Output) WriteToBuffer(buffer *bytes.Buffer, outBytes []byte, or OutputRunner) (err error) {
 	_, err = buffer.Write(outBytes)
 	if err != nil {
 		return
 	}
+	bytesBufferedTotal.With(so.metricLabels()).Add(float64(len(outBytes)))
 	if buffer.Len() > so.config.BufferChunkLimit {
 		err = so.SaveToDisk(buffer, or)
 	}
@@ -156,11 +386,6 @@ func (so *S3Output) SaveToDisk(buffer *bytes.Buffer, or OutputRunner) error {
 		}
 	}
 
-	err = os.Chdir(so.config.BufferPath)
-	if err != nil {
-		return err
-	}
-
 	_, err = os.Stat(so.bufferFilePath)
 	if os.IsNotExist(err) {
 		or.LogMessage("Creating buffer file: " + so.bufferFilePath)
@@ -177,57 +402,54 @@ func (so *S3Output) SaveToDisk(buffer *bytes.Buffer, or OutputRunner) error {
 	}
 	defer f.Close()
 
-	_, err = f.Write(buffer.Bytes())
+	if so.config.StreamingCompression {
+		gw := gzip.NewWriter(f)
+		if _, err = gw.Write(buffer.Bytes()); err != nil {
+			return err
+		}
+		err = gw.Close()
+	} else {
+		_, err = f.Write(buffer.Bytes())
+	}
 	if err != nil {
 		return err
 	}
 
 	buffer.Reset()
 
-	return nil
-}
-
-// ReadFromDisk reads and optionally compresses the file from disk and returns a buffer of its contents.
-func (so *S3Output) ReadFromDisk(or OutputRunner) (buffer *bytes.Buffer, err error) {
-	fi, err := os.Open(so.bufferFilePath)
-	if err != nil {
-		return
+	if fi, statErr := f.Stat(); statErr == nil {
+		bufferSizeBytes.With(so.metricLabels()).Set(float64(fi.Size()))
 	}
-	defer fi.Close()
 
-	if so.config.Compression {
-		or.LogMessage("Reading and compressing buffer file.")
-		w := gzip.NewWriter(buffer)
-		_, err = io.Copy(w, fi)
-		w.Close()
-	} else {
-		or.LogMessage("Reading buffer file.")
-		_, err = io.Copy(buffer, fi)
-	}
-
-	return buffer, err
+	return nil
 }
 
-// Upload flushes any remaining buffer contents to disk and then uploads the file contents to S3.
-func (so *S3Output) Upload(buffer *bytes.Buffer, or OutputRunner, isMidnight bool) (err error) {
-	_, err = os.Stat(so.bufferFilePath)
-	if buffer.Len() == 0 && os.IsNotExist(err) {
-		err = errors.New("Nothing to upload.")
-		return
+// rotateBuffer flushes any remaining buffer contents to disk, then renames
+// the active buffer file out from under future writers so it can be handed
+// to an upload worker. Returns an empty path if there was nothing to
+// rotate.
+func (so *S3Output) rotateBuffer(buffer *bytes.Buffer, or OutputRunner) (string, error) {
+	if buffer.Len() > 0 {
+		if err := so.SaveToDisk(buffer, or); err != nil {
+			return "", err
+		}
 	}
 
-	err = so.SaveToDisk(buffer, or)
-	if err != nil {
-		or.LogMessage("Cannot save to disk")
-		return
+	if _, err := os.Stat(so.bufferFilePath); os.IsNotExist(err) {
+		return "", nil
 	}
 
-	buffer, err = so.ReadFromDisk(or)
-	if err != nil {
-		or.LogMessage("Cannot read from disk")
-		return
+	rotatedPath := fmt.Sprintf("%s.%d", so.bufferFilePath, time.Now().UnixNano())
+	if err := os.Rename(so.bufferFilePath, rotatedPath); err != nil {
+		return "", err
 	}
+	return rotatedPath, nil
+}
 
+// uploadFile streams the already-rotated buffer file at path to S3 through
+// the multipart uploader, so payloads never need to be fully resident in
+// memory.
+func (so *S3Output) uploadFile(path string, or OutputRunner, isMidnight bool, attempt int) (err error) {
 	var (
 		currentTime = time.Now().Local().Format("2006-01-02_150405")
 		currentDate = ""
@@ -241,21 +463,124 @@ func (so *S3Output) Upload(buffer *bytes.Buffer, or OutputRunner, isMidnight boo
 		currentDate = time.Now().UTC().Format("2006-01-02")
 	}
 
+	// uploadPath holds exactly the bytes that will be sent to S3, so the
+	// SHA-256 used for content-addressable keying and the Content-MD5
+	// integrity header both describe the uploaded object itself.
+	uploadPath := path
 	if so.config.Compression {
 		ext = ".gz"
 		contentType = "multipart/x-gzip"
+		if !so.config.StreamingCompression {
+			uploadPath, err = so.gzipToTemp(path)
+			if err != nil {
+				or.LogMessage("Cannot compress buffer file")
+				return
+			}
+			defer os.Remove(uploadPath)
+		}
+	}
+
+	sum, md5sum, err := hashFile(uploadPath)
+	if err != nil {
+		or.LogMessage("Cannot hash buffer file")
+		return
 	}
 
-	path := so.config.Prefix + "/" + currentDate + "/" + currentTime + ext
-	err = so.bucket.Put(path, buffer.Bytes(), contentType, s3.Private, s3.Options{})
+	fi, err := os.Open(uploadPath)
+	if err != nil {
+		or.LogMessage("Cannot read from disk")
+		return
+	}
+	defer fi.Close()
 
-	or.LogMessage("Upload finished, removing buffer file on disk.")
-	if err == nil {
-		err = os.Remove(so.bufferFilePath)
-	} else {
+	key := so.config.Prefix + "/" + currentDate + "/" + currentTime + "-" + sum[:16] + ext
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(so.config.Bucket),
+		Key:         aws.String(key),
+		Body:        fi,
+		ContentType: aws.String(contentType),
+		ContentMD5:  aws.String(md5sum),
+		ACL:         s3.ObjectCannedACL(so.config.ACL),
+	}
+	if so.config.ServerSideEncryption != "" {
+		input.ServerSideEncryption = s3.ServerSideEncryption(so.config.ServerSideEncryption)
+		if so.config.ServerSideEncryption == "aws:kms" && so.config.SSEKMSKeyId != "" {
+			input.SSEKMSKeyId = aws.String(so.config.SSEKMSKeyId)
+		}
+	}
+
+	fiInfo, statErr := fi.Stat()
+	if statErr != nil {
+		err = statErr
+		return
+	}
+
+	log := so.logger.WithFields(logrus.Fields{"key": key, "size": fiInfo.Size(), "attempt": attempt})
+
+	start := time.Now()
+	_, err = so.uploader.Upload(input)
+	uploadLatencySeconds.With(so.metricLabels()).Observe(time.Since(start).Seconds())
+	if err != nil {
+		uploadErrorsTotal.With(so.metricLabels()).Inc()
+		log.WithError(err).Error("upload failed")
 		or.LogMessage("Error putting to S3 bucket")
+		return
+	}
+
+	bytesUploadedTotal.With(so.metricLabels()).Add(float64(fiInfo.Size()))
+	log.Info("upload succeeded")
+	or.LogMessage("Upload finished, moving buffer file to trash.")
+	err = so.trashBuffer(or, path, key, fiInfo.Size())
+
+	return
+}
+
+// gzipToTemp compresses path into a sibling "<path>.gz.tmp" file and
+// returns its name. Used when StreamingCompression is off, so the buffer
+// file can still be hashed and uploaded from disk rather than a one-shot
+// in-memory gzip of the whole thing.
+func (so *S3Output) gzipToTemp(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dstPath := path + ".gz.tmp"
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	gw := gzip.NewWriter(dst)
+	if _, err = io.Copy(gw, src); err != nil {
+		return "", err
+	}
+	if err = gw.Close(); err != nil {
+		return "", err
+	}
+	return dstPath, nil
+}
+
+// hashFile returns the hex-encoded SHA-256 (for content-addressable
+// keying) and the base64-encoded MD5 (for the S3 Content-MD5 integrity
+// header) of the file at path.
+func hashFile(path string) (sha256sum string, md5sum string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	sha := sha256.New()
+	md := md5.New()
+	if _, err = io.Copy(io.MultiWriter(sha, md), f); err != nil {
+		return
 	}
 
+	sha256sum = hex.EncodeToString(sha.Sum(nil))
+	md5sum = base64.StdEncoding.EncodeToString(md.Sum(nil))
 	return
 }
 
@@ -0,0 +1,198 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+const trashSweepInterval = 5 * time.Minute
+
+// trashMarker tags a rotated buffer file whose upload verified successfully
+// and is just waiting out RaceWindow before being unlinked. failedMarker
+// tags one whose verification failed: recoverOrphanBuffers re-enqueues
+// these for upload on the next restart instead of sweepTrash reclaiming
+// them by age, since a failed-to-verify file may be the only surviving
+// copy of data that never durably landed in S3.
+const (
+	trashMarker  = ".trash."
+	failedMarker = ".trash-failed."
+)
+
+// trashBuffer re-HEADs the uploaded key to confirm it landed durably, then
+// renames the just-uploaded buffer file into the trash, where it is
+// unlinked once RaceWindow has passed. A file that fails verification is
+// renamed with failedMarker instead (or kept at its rotated path if that
+// rename fails), so recoverOrphanBuffers re-uploads it on the next restart
+// and a crash never leaves an unverified upload for sweepTrash to reclaim.
+func (so *S3Output) trashBuffer(or OutputRunner, path string, key string, expectedSize int64) error {
+	if err := so.verifyUpload(key, expectedSize); err != nil {
+		failedPath := fmt.Sprintf("%s%s%d", path, failedMarker, time.Now().UnixNano())
+		if rerr := os.Rename(path, failedPath); rerr != nil {
+			or.LogMessage(fmt.Sprintf("Warning, could not verify uploaded object %s: %s; keeping %s", key, err, path))
+			return nil
+		}
+		or.LogMessage(fmt.Sprintf("Warning, could not verify uploaded object %s: %s; will retry %s on next restart", key, err, failedPath))
+		return nil
+	}
+
+	trashPath := fmt.Sprintf("%s%s%d", path, trashMarker, time.Now().UnixNano())
+	if err := os.Rename(path, trashPath); err != nil {
+		return err
+	}
+
+	raceWindow := time.Duration(so.config.RaceWindow) * time.Second
+	go func() {
+		time.Sleep(raceWindow)
+		if err := os.Remove(trashPath); err != nil && !os.IsNotExist(err) {
+			or.LogMessage(fmt.Sprintf("Warning, could not unlink trash file %s: %s", trashPath, err))
+		}
+	}()
+	return nil
+}
+
+// verifyUpload HEADs key and confirms its size matches what was sent.
+func (so *S3Output) verifyUpload(key string, expectedSize int64) error {
+	req := so.client.HeadObjectRequest(&s3.HeadObjectInput{
+		Bucket: aws.String(so.config.Bucket),
+		Key:    aws.String(key),
+	})
+	resp, err := req.Send(context.Background())
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength == nil || *resp.ContentLength != expectedSize {
+		return fmt.Errorf("size mismatch for %s", key)
+	}
+	return nil
+}
+
+// sweepTrash removes orphaned "*.trash.<nanos>" files (rotated buffer files
+// whose upload verified successfully) that have outlived TrashLifetime. A
+// trash file only survives this long if the process crashed before its
+// scheduled unlink in trashBuffer ran. Files tagged with failedMarker are
+// deliberately not matched here -- recoverOrphanBuffers re-enqueues those
+// for upload instead of letting them age out.
+func (so *S3Output) sweepTrash(or OutputRunner) {
+	dir := filepath.Dir(so.bufferFilePath)
+	base := filepath.Base(so.bufferFilePath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	lifetime := time.Duration(so.config.TrashLifetime) * time.Second
+
+	for _, entry := range entries {
+		name := entry.Name()
+		nanos, ok := parseTrashFile(name, base)
+		if !ok {
+			continue
+		}
+		if time.Since(time.Unix(0, nanos)) < lifetime {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			or.LogMessage(fmt.Sprintf("Warning, could not sweep trash file %s: %s", path, err))
+		}
+	}
+}
+
+// parseTrashFile reports whether name is a verified trash file rotated from
+// the buffer file named base (i.e. "<base>.<nanos>.trash.<nanos>"),
+// returning the UnixNano timestamp of when it was trashed. Files tagged
+// with failedMarker rather than trashMarker do not match.
+func parseTrashFile(name, base string) (nanos int64, ok bool) {
+	if !strings.HasPrefix(name, base+".") {
+		return 0, false
+	}
+	idx := strings.LastIndex(name, trashMarker)
+	if idx == -1 {
+		return 0, false
+	}
+	nanos, err := strconv.ParseInt(name[idx+len(trashMarker):], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return nanos, true
+}
+
+// runTrashSweeper periodically sweeps orphaned trash files until stop is
+// closed.
+func (so *S3Output) runTrashSweeper(or OutputRunner, stop <-chan struct{}) {
+	ticker := time.NewTicker(trashSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			so.sweepTrash(or)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// recoverOrphanBuffers finds buffer files left behind by a crash -- the
+// active bufferFilePath, any already-rotated "<bufferFilePath>.<nanos>"
+// files that never finished uploading, and any failedMarker-tagged trash
+// files whose upload verification never succeeded -- and enqueues each for
+// upload, so a Heka restart never silently drops data that was already
+// flushed to disk. Verified ".trash." files are left for sweepTrash.
+// Leftover ".gz.tmp" compression scratch files are skipped; neither this
+// nor sweepTrash removes them.
+func (so *S3Output) recoverOrphanBuffers(or OutputRunner, uploadJobs chan<- uploadJob) {
+	if _, err := os.Stat(so.bufferFilePath); err == nil {
+		if rotated, rerr := so.rotateBuffer(bytes.NewBuffer(nil), or); rerr == nil && rotated != "" {
+			or.LogMessage(fmt.Sprintf("Found active buffer file from a previous run, re-uploading %s.", rotated))
+			uploadJobs <- uploadJob{path: rotated}
+		} else if rerr != nil {
+			or.LogMessage(fmt.Sprintf("Warning, could not recover active buffer file: %s", rerr))
+		}
+	}
+
+	dir := filepath.Dir(so.bufferFilePath)
+	base := filepath.Base(so.bufferFilePath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base+".") {
+			continue
+		}
+
+		if idx := strings.Index(name, failedMarker); idx != -1 {
+			origPath := filepath.Join(dir, name[:idx])
+			failedPath := filepath.Join(dir, name)
+			if rerr := os.Rename(failedPath, origPath); rerr != nil {
+				or.LogMessage(fmt.Sprintf("Warning, could not recover failed-verification buffer file %s: %s", failedPath, rerr))
+				continue
+			}
+			or.LogMessage(fmt.Sprintf("Found failed-verification buffer file from a previous run, re-uploading %s.", origPath))
+			uploadJobs <- uploadJob{path: origPath}
+			continue
+		}
+
+		if strings.Contains(name, trashMarker) || strings.HasSuffix(name, ".gz.tmp") {
+			continue
+		}
+		if _, err := strconv.ParseInt(strings.TrimPrefix(name, base+"."), 10, 64); err != nil {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		or.LogMessage(fmt.Sprintf("Found rotated buffer file from a previous run, re-uploading %s.", path))
+		uploadJobs <- uploadJob{path: path}
+	}
+}
@@ -0,0 +1,26 @@
+package s3
+
+import "testing"
+
+func TestParseTrashFile(t *testing.T) {
+	cases := []struct {
+		name      string
+		base      string
+		wantNanos int64
+		wantOK    bool
+	}{
+		{"buf.1700000000000000000.trash.1700000001000000000", "buf", 1700000001000000000, true},
+		{"buf.1700000000000000000", "buf", 0, false},
+		{"buf.trash.notanumber", "buf", 0, false},
+		{"other.1700000000000000000.trash.1700000001000000000", "buf", 0, false},
+		{"buf.gz.tmp", "buf", 0, false},
+		{"buf.1700000000000000000.trash-failed.1700000001000000000", "buf", 0, false},
+	}
+
+	for _, c := range cases {
+		nanos, ok := parseTrashFile(c.name, c.base)
+		if ok != c.wantOK || nanos != c.wantNanos {
+			t.Errorf("parseTrashFile(%q, %q) = (%d, %v), want (%d, %v)", c.name, c.base, nanos, ok, c.wantNanos, c.wantOK)
+		}
+	}
+}